@@ -0,0 +1,220 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmasq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// defaultNonMasqCIDRsV4 are the private IPv4 ranges that are never
+// masqueraded when a config doesn't set nonMasqueradeCIDRs explicitly (see
+// applyDefaults), mirroring the defaults used by the upstream Kubernetes
+// ip-masq-agent.
+var defaultNonMasqCIDRsV4 = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+}
+
+// defaultNonMasqCIDRsV6 is the IPv6 analog of defaultNonMasqCIDRsV4: unique
+// local and loopback ranges that should never be masqueraded.
+var defaultNonMasqCIDRsV6 = []string{
+	"fc00::/7",
+	"::1/128",
+}
+
+const (
+	linkLocalCIDRV4 = "169.254.0.0/16"
+	linkLocalCIDRV6 = "fe80::/10"
+)
+
+// config is the representation of ip-masq-agent configuration, whether it
+// originates from a local file (encoded as YAML or JSON) or from a
+// CiliumIPMasqConfig CRD.
+type config struct {
+	NonMasqueradeCIDRs   []string `json:"nonMasqueradeCIDRs,omitempty"`
+	NonMasqueradeCIDRsV6 []string `json:"nonMasqueradeCIDRsV6,omitempty"`
+	MasqLinkLocal        bool     `json:"masqLinkLocal,omitempty"`
+	MasqLinkLocalV6      bool     `json:"masqLinkLocalV6,omitempty"`
+}
+
+// readConfig reads and parses the ip-masq-agent config file. A missing file
+// is not an error: it yields an empty config, so that a deleted config file
+// causes all CIDRs to be torn down from the maps rather than falling back
+// to defaults. A file that is present but doesn't set a family's CIDR list
+// falls back to that family's defaults; either way, the masqLinkLocal(V6)
+// toggle is then applied to the resulting list.
+func readConfig(path string) (*config, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{}
+	if err := yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+
+	applyDefaults(cfg)
+	return cfg, nil
+}
+
+// applyDefaults fills in the default non-masquerade CIDRs, per address
+// family, for any family cfg didn't set explicitly, then applies that
+// family's masqLinkLocal toggle to the resulting list (default or custom)
+// so that link-local traffic is masqueraded or not regardless of whether
+// the operator also customized the rest of the CIDR list.
+func applyDefaults(cfg *config) {
+	if cfg.NonMasqueradeCIDRs == nil {
+		cfg.NonMasqueradeCIDRs = append([]string{}, defaultNonMasqCIDRsV4...)
+	}
+	cfg.NonMasqueradeCIDRs = applyLinkLocal(cfg.NonMasqueradeCIDRs, linkLocalCIDRV4, cfg.MasqLinkLocal)
+
+	if cfg.NonMasqueradeCIDRsV6 == nil {
+		cfg.NonMasqueradeCIDRsV6 = append([]string{}, defaultNonMasqCIDRsV6...)
+	}
+	cfg.NonMasqueradeCIDRsV6 = applyLinkLocal(cfg.NonMasqueradeCIDRsV6, linkLocalCIDRV6, cfg.MasqLinkLocalV6)
+}
+
+// applyLinkLocal makes linkLocalCIDR's presence in cidrs match masqLinkLocal:
+// present (added if missing) when masqLinkLocal is false, so that link-local
+// traffic is never masqueraded by default; absent (removed if present) when
+// it is true, so that link-local traffic is masqueraded like any other
+// destination.
+func applyLinkLocal(cidrs []string, linkLocalCIDR string, masqLinkLocal bool) []string {
+	idx := -1
+	for i, s := range cidrs {
+		if s == linkLocalCIDR {
+			idx = i
+			break
+		}
+	}
+
+	if masqLinkLocal {
+		if idx >= 0 {
+			cidrs = append(cidrs[:idx], cidrs[idx+1:]...)
+		}
+		return cidrs
+	}
+
+	if idx < 0 {
+		cidrs = append(cidrs, linkLocalCIDR)
+	}
+	return cidrs
+}
+
+// mergeConfigs layers configs in priority order: the first config in the
+// slice that sets a given field wins that field outright. A nil entry (a
+// source with nothing loaded yet) is skipped. masqLinkLocal(V6) is ORed
+// across every config, since it's a toggle rather than a list: if anything
+// asks for link-local traffic to be masqueraded, it is.
+func mergeConfigs(configs ...*config) *config {
+	merged := &config{}
+	for _, cfg := range configs {
+		if cfg == nil {
+			continue
+		}
+		if merged.NonMasqueradeCIDRs == nil && cfg.NonMasqueradeCIDRs != nil {
+			merged.NonMasqueradeCIDRs = cfg.NonMasqueradeCIDRs
+		}
+		if merged.NonMasqueradeCIDRsV6 == nil && cfg.NonMasqueradeCIDRsV6 != nil {
+			merged.NonMasqueradeCIDRsV6 = cfg.NonMasqueradeCIDRsV6
+		}
+		merged.MasqLinkLocal = merged.MasqLinkLocal || cfg.MasqLinkLocal
+		merged.MasqLinkLocalV6 = merged.MasqLinkLocalV6 || cfg.MasqLinkLocalV6
+	}
+	return merged
+}
+
+// unionConfigs merges configs that are all at the same priority tier (e.g.
+// every cluster-wide CiliumIPMasqConfig): each family's CIDR list is the
+// deduplicated union of every config's list for that family, rather than a
+// single winner, so that multiple objects in the same tier all take
+// effect. A family is left nil if no config in the tier set it, so that
+// mergeConfigs can still fall through to a lower-priority tier for it.
+// masqLinkLocal(V6) is ORed across the tier, same as in mergeConfigs.
+func unionConfigs(configs []*config) *config {
+	v4, v6 := []string{}, []string{}
+	haveV4, haveV6 := false, false
+	seenV4 := map[string]struct{}{}
+	seenV6 := map[string]struct{}{}
+
+	merged := &config{}
+	for _, cfg := range configs {
+		if cfg == nil {
+			continue
+		}
+
+		if cfg.NonMasqueradeCIDRs != nil {
+			haveV4 = true
+			for _, s := range cfg.NonMasqueradeCIDRs {
+				if _, ok := seenV4[s]; !ok {
+					seenV4[s] = struct{}{}
+					v4 = append(v4, s)
+				}
+			}
+		}
+		if cfg.NonMasqueradeCIDRsV6 != nil {
+			haveV6 = true
+			for _, s := range cfg.NonMasqueradeCIDRsV6 {
+				if _, ok := seenV6[s]; !ok {
+					seenV6[s] = struct{}{}
+					v6 = append(v6, s)
+				}
+			}
+		}
+		merged.MasqLinkLocal = merged.MasqLinkLocal || cfg.MasqLinkLocal
+		merged.MasqLinkLocalV6 = merged.MasqLinkLocalV6 || cfg.MasqLinkLocalV6
+	}
+
+	if haveV4 {
+		merged.NonMasqueradeCIDRs = v4
+	}
+	if haveV6 {
+		merged.NonMasqueradeCIDRsV6 = v6
+	}
+	return merged
+}
+
+// parseCIDRs parses cidrStrs into a set of net.IPNet keyed by their
+// canonical string form, along with the number of entries that failed to
+// parse. Each entry may be CIDR notation or an inclusive address range
+// ("10.0.0.5-10.0.0.37"), which is expanded into its minimal covering set
+// of CIDR blocks. Entries that are neither are skipped and logged.
+func parseCIDRs(cidrStrs []string) (map[string]net.IPNet, int) {
+	cidrs := make(map[string]net.IPNet, len(cidrStrs))
+	errs := 0
+	for _, s := range cidrStrs {
+		expanded, err := expandCIDROrRange(s)
+		if err != nil {
+			log.WithError(err).WithField("cidr", s).Warning("skipping invalid non-masquerade CIDR or range")
+			errs++
+			continue
+		}
+		for _, ipnet := range expanded {
+			cidrs[ipnet.String()] = ipnet
+		}
+	}
+	return cidrs, errs
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmasq
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configCheckInterval is the fallback poll period; fsnotify events normally
+// pick up changes much sooner than this, but editors and some container
+// runtimes do not always generate events we can rely on.
+const configCheckInterval = 1 * time.Minute
+
+// ConfigSource supplies ip-masq-agent configuration from a single origin (a
+// local file, a Kubernetes CRD, ...) and notifies the agent whenever it
+// changes.
+type ConfigSource interface {
+	// Name identifies the source in logs and metrics. It is also used as
+	// the source's key when the agent merges configs from multiple
+	// sources, so it must be stable and unique per source instance.
+	Name() string
+	// Start begins watching for changes. It must invoke onChange
+	// synchronously at least once, with the source's current config (nil
+	// if the source currently has none), before returning, so that the
+	// agent's first reconcile already reflects every configured source. If
+	// a change could not be loaded at all (e.g. a file that fails to parse),
+	// onChange is called with a nil cfg and the error instead, so the
+	// failure is still observable; the source keeps its previous config in
+	// that case.
+	Start(onChange func(cfg *config, err error)) error
+	// Stop stops watching for changes.
+	Stop()
+}
+
+// FileConfigSource is a ConfigSource backed by a single local file, watched
+// via fsnotify and re-read on every write, rename or fallback poll tick.
+type FileConfigSource struct {
+	path    string
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
+}
+
+// NewFileConfigSource returns a ConfigSource which watches path.
+func NewFileConfigSource(path string) *FileConfigSource {
+	return &FileConfigSource{path: path}
+}
+
+// Name implements ConfigSource.
+func (f *FileConfigSource) Name() string {
+	return "file:" + f.path
+}
+
+// Start implements ConfigSource.
+func (f *FileConfigSource) Start(onChange func(cfg *config, err error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create fsnotify watcher: %w", err)
+	}
+
+	configDir := filepath.Dir(f.path)
+	if err := watcher.Add(configDir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("unable to watch %s: %w", configDir, err)
+	}
+
+	f.watcher = watcher
+	f.stop = make(chan struct{})
+
+	load := func() {
+		cfg, err := readConfig(f.path)
+		if err != nil {
+			log.WithError(err).WithField("path", f.path).Warning("unable to parse ip-masq-agent config file, keeping previous config")
+			onChange(nil, err)
+			return
+		}
+		onChange(cfg, nil)
+	}
+
+	// Load synchronously so the first reconcile already reflects the file
+	// on disk.
+	load()
+
+	go func() {
+		ticker := time.NewTicker(configCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-f.stop:
+				watcher.Close()
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(f.path) {
+					load()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).WithField("path", f.path).Warning("error while watching ip-masq-agent config file")
+			case <-ticker.C:
+				load()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop implements ConfigSource.
+func (f *FileConfigSource) Stop() {
+	close(f.stop)
+}
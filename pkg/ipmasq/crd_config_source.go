@@ -0,0 +1,191 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmasq
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// CiliumIPMasqConfig is the spec of the cluster-scoped CRD that supplies
+// ip-masq-agent configuration from Kubernetes, as an alternative or
+// complement to the local config file.
+type CiliumIPMasqConfig struct {
+	metav1.TypeMeta
+	metav1.ObjectMeta
+
+	Spec CiliumIPMasqConfigSpec
+}
+
+// CiliumIPMasqConfigSpec is the desired ip-masq-agent configuration carried
+// by a CiliumIPMasqConfig object.
+type CiliumIPMasqConfigSpec struct {
+	NonMasqueradeCIDRs   []string `json:"nonMasqueradeCIDRs,omitempty"`
+	NonMasqueradeCIDRsV6 []string `json:"nonMasqueradeCIDRsV6,omitempty"`
+	MasqLinkLocal        bool     `json:"masqLinkLocal,omitempty"`
+	MasqLinkLocalV6      bool     `json:"masqLinkLocalV6,omitempty"`
+
+	// NodeSelector restricts this object's effect to nodes whose labels
+	// match. A nil selector applies the object cluster-wide.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+}
+
+// CiliumIPMasqConfigList is a list of CiliumIPMasqConfig, as returned by the
+// generated clientset's List call.
+type CiliumIPMasqConfigList struct {
+	metav1.TypeMeta
+	metav1.ListMeta
+
+	Items []CiliumIPMasqConfig
+}
+
+// DeepCopyObject implements runtime.Object so CiliumIPMasqConfigList can be
+// handed to a cache.ListWatch.
+func (l *CiliumIPMasqConfigList) DeepCopyObject() runtime.Object {
+	out := *l
+	out.Items = append([]CiliumIPMasqConfig{}, l.Items...)
+	return &out
+}
+
+// DeepCopyObject implements runtime.Object so CiliumIPMasqConfig can be
+// stored in a cache.Store.
+func (c *CiliumIPMasqConfig) DeepCopyObject() runtime.Object {
+	out := *c
+	return &out
+}
+
+// ciliumIPMasqConfigClient is the subset of the generated CiliumIPMasqConfig
+// clientset the source needs. It is satisfied by the real k8s client
+// factory's typed client and, in tests, by a fake.
+type ciliumIPMasqConfigClient interface {
+	List(ctx context.Context, opts metav1.ListOptions) (*CiliumIPMasqConfigList, error)
+	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+}
+
+// CRDConfigSource is a ConfigSource backed by the cluster-scoped
+// CiliumIPMasqConfig CRD. It merges every cluster-wide object (no
+// NodeSelector) with every object whose NodeSelector matches this node's
+// labels, with node-local objects taking priority.
+type CRDConfigSource struct {
+	client     ciliumIPMasqConfigClient
+	nodeLabels labels.Set
+
+	store    cache.Store
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCRDConfigSource returns a ConfigSource which watches CiliumIPMasqConfig
+// objects via client, evaluating NodeSelector against nodeLabels.
+func NewCRDConfigSource(client ciliumIPMasqConfigClient, nodeLabels map[string]string) *CRDConfigSource {
+	return &CRDConfigSource{
+		client:     client,
+		nodeLabels: labels.Set(nodeLabels),
+	}
+}
+
+// Name implements ConfigSource.
+func (c *CRDConfigSource) Name() string {
+	return "crd:CiliumIPMasqConfig"
+}
+
+// Start implements ConfigSource.
+func (c *CRDConfigSource) Start(onChange func(cfg *config, err error)) error {
+	c.stop = make(chan struct{})
+
+	recompute := func() { onChange(c.mergeObjects(), nil) }
+
+	listWatch := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return c.client.List(context.Background(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return c.client.Watch(context.Background(), opts)
+		},
+	}
+
+	store, controller := cache.NewInformer(listWatch, &CiliumIPMasqConfig{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { recompute() },
+		UpdateFunc: func(oldObj, newObj interface{}) { recompute() },
+		DeleteFunc: func(obj interface{}) { recompute() },
+	})
+	c.store = store
+
+	go controller.Run(c.stop)
+
+	if !cache.WaitForCacheSync(c.stop, controller.HasSynced) {
+		c.stopOnce.Do(func() { close(c.stop) })
+		return fmt.Errorf("timed out waiting for CiliumIPMasqConfig cache sync")
+	}
+
+	recompute()
+	return nil
+}
+
+// Stop implements ConfigSource.
+func (c *CRDConfigSource) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// mergeObjects unions the CIDRs of every cluster-wide CiliumIPMasqConfig
+// with the CIDRs of every object whose NodeSelector matches this node's
+// labels, with the node-local tier taking priority field-for-field over the
+// cluster-wide tier.
+func (c *CRDConfigSource) mergeObjects() *config {
+	var ipMasqCfgs []*CiliumIPMasqConfig
+	for _, obj := range c.store.List() {
+		if ipMasqCfg, ok := obj.(*CiliumIPMasqConfig); ok {
+			ipMasqCfgs = append(ipMasqCfgs, ipMasqCfg)
+		}
+	}
+	sort.Slice(ipMasqCfgs, func(i, j int) bool {
+		return ipMasqCfgs[i].Name < ipMasqCfgs[j].Name
+	})
+
+	var clusterWide, nodeLocal []*config
+
+	for _, ipMasqCfg := range ipMasqCfgs {
+		cfg := &config{
+			NonMasqueradeCIDRs:   ipMasqCfg.Spec.NonMasqueradeCIDRs,
+			NonMasqueradeCIDRsV6: ipMasqCfg.Spec.NonMasqueradeCIDRsV6,
+			MasqLinkLocal:        ipMasqCfg.Spec.MasqLinkLocal,
+			MasqLinkLocalV6:      ipMasqCfg.Spec.MasqLinkLocalV6,
+		}
+
+		if ipMasqCfg.Spec.NodeSelector == nil {
+			clusterWide = append(clusterWide, cfg)
+			continue
+		}
+
+		selector, err := metav1.LabelSelectorAsSelector(ipMasqCfg.Spec.NodeSelector)
+		if err != nil {
+			log.WithError(err).WithField("name", ipMasqCfg.Name).Warning("invalid nodeSelector on CiliumIPMasqConfig, ignoring object")
+			continue
+		}
+		if selector.Matches(c.nodeLabels) {
+			nodeLocal = append(nodeLocal, cfg)
+		}
+	}
+
+	return mergeConfigs(unionConfigs(nodeLocal), unionConfigs(clusterWide))
+}
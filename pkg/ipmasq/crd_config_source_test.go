@@ -0,0 +1,258 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !privileged_tests
+
+package ipmasq
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"gopkg.in/check.v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+type fakeCRDClient struct {
+	lock.Mutex
+	objects map[string]*CiliumIPMasqConfig
+	watcher *watch.FakeWatcher
+}
+
+func newFakeCRDClient() *fakeCRDClient {
+	return &fakeCRDClient{
+		objects: map[string]*CiliumIPMasqConfig{},
+		watcher: watch.NewFake(),
+	}
+}
+
+func (f *fakeCRDClient) List(ctx context.Context, opts metav1.ListOptions) (*CiliumIPMasqConfigList, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	list := &CiliumIPMasqConfigList{}
+	for _, obj := range f.objects {
+		list.Items = append(list.Items, *obj)
+	}
+	return list, nil
+}
+
+func (f *fakeCRDClient) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return f.watcher, nil
+}
+
+func (f *fakeCRDClient) add(obj *CiliumIPMasqConfig) {
+	f.Lock()
+	f.objects[obj.Name] = obj
+	f.Unlock()
+	f.watcher.Add(obj)
+}
+
+func (f *fakeCRDClient) update(obj *CiliumIPMasqConfig) {
+	f.Lock()
+	f.objects[obj.Name] = obj
+	f.Unlock()
+	f.watcher.Modify(obj)
+}
+
+func (f *fakeCRDClient) delete(obj *CiliumIPMasqConfig) {
+	f.Lock()
+	delete(f.objects, obj.Name)
+	f.Unlock()
+	f.watcher.Delete(obj)
+}
+
+type CRDConfigSourceTestSuite struct {
+	client      *fakeCRDClient
+	ipMasqMap   *ipMasqMapMock
+	ipMasqMapV6 *ipMasqMapMock
+	agent       *IPMasqAgent
+}
+
+var _ = check.Suite(&CRDConfigSourceTestSuite{})
+
+func (s *CRDConfigSourceTestSuite) SetUpTest(c *check.C) {
+	s.client = newFakeCRDClient()
+	s.ipMasqMap = &ipMasqMapMock{cidrs: map[string]net.IPNet{}}
+	s.ipMasqMapV6 = &ipMasqMapMock{cidrs: map[string]net.IPNet{}}
+
+	source := NewCRDConfigSource(s.client, map[string]string{"node-role": "worker"})
+	agent, err := newIPMasqAgentWithSources([]ConfigSource{source}, s.ipMasqMap, s.ipMasqMapV6)
+	c.Assert(err, check.IsNil)
+	s.agent = agent
+	c.Assert(s.agent.Start(), check.IsNil)
+}
+
+func (s *CRDConfigSourceTestSuite) TearDownTest(c *check.C) {
+	s.agent.Stop()
+}
+
+func (s *CRDConfigSourceTestSuite) TestAddUpdateDelete(c *check.C) {
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"},
+		Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{"10.0.0.0/8"}},
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets := s.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 1)
+	_, ok := ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+
+	s.client.update(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"},
+		Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{"10.0.0.0/8", "172.16.0.0/12"}},
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets = s.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 2)
+
+	s.client.delete(&CiliumIPMasqConfig{ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"}})
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets = s.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 0)
+}
+
+func (s *CRDConfigSourceTestSuite) TestNodeLocalOverride(c *check.C) {
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"},
+		Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{"10.0.0.0/8"}},
+	})
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-only"},
+		Spec: CiliumIPMasqConfigSpec{
+			NonMasqueradeCIDRs: []string{"192.168.0.0/16"},
+			NodeSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"node-role": "worker"}},
+		},
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	// The node-local object overrides the cluster-wide one field-for-field.
+	ipnets := s.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 1)
+	_, ok := ipnets["192.168.0.0/16"]
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *CRDConfigSourceTestSuite) TestMergesMultipleClusterWideObjects(c *check.C) {
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide-a"},
+		Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{"10.0.0.0/8"}},
+	})
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide-b"},
+		Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{"172.16.0.0/12"}},
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	// Both cluster-wide objects' CIDRs must take effect, not just one.
+	ipnets := s.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 2)
+	_, ok := ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+	_, ok = ipnets["172.16.0.0/12"]
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *CRDConfigSourceTestSuite) TestNodeLocalExplicitEmptyCIDRsOverridesClusterWide(c *check.C) {
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"},
+		Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{"10.0.0.0/8"}},
+	})
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-only"},
+		Spec: CiliumIPMasqConfigSpec{
+			NonMasqueradeCIDRs: []string{},
+			NodeSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"node-role": "worker"}},
+		},
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	// The node-local object's explicit empty nonMasqueradeCIDRs must win
+	// outright over the cluster-wide tier's list, not be treated as unset
+	// and fall through to it.
+	ipnets := s.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 0)
+}
+
+// blockingCRDClient wraps a fakeCRDClient whose List blocks until release is
+// closed, so a test can force the informer's initial sync to still be
+// pending while it exercises what happens if the source is stopped out from
+// under it.
+type blockingCRDClient struct {
+	*fakeCRDClient
+	release chan struct{}
+}
+
+func (b *blockingCRDClient) List(ctx context.Context, opts metav1.ListOptions) (*CiliumIPMasqConfigList, error) {
+	<-b.release
+	return b.fakeCRDClient.List(ctx, opts)
+}
+
+func (s *CRDConfigSourceTestSuite) TestStartStopsControllerOnSyncTimeout(c *check.C) {
+	client := &blockingCRDClient{fakeCRDClient: newFakeCRDClient(), release: make(chan struct{})}
+	source := NewCRDConfigSource(client, map[string]string{"node-role": "worker"})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- source.Start(func(cfg *config, err error) {}) }()
+
+	// Give the informer's first List time to start blocking, then stop the
+	// source out from under it, as IPMasqAgent.Start's rollback would if a
+	// later source failed while this one was still syncing.
+	time.Sleep(100 * time.Millisecond)
+	source.Stop()
+
+	select {
+	case err := <-errCh:
+		c.Assert(err, check.ErrorMatches, ".*timed out.*")
+	case <-time.After(time.Second):
+		c.Fatal("Start did not return after the source was stopped")
+	}
+
+	// Stop must be safe to call again without panicking on an
+	// already-closed channel: Start's own cleanup on the sync-timeout path
+	// and an outer Stop() can both race to close it.
+	source.Stop()
+
+	close(client.release)
+}
+
+func (s *CRDConfigSourceTestSuite) TestRestoreAfterRestartRemovesStaleEntries(c *check.C) {
+	s.client.add(&CiliumIPMasqConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"},
+		Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{"10.0.0.0/8"}},
+	})
+	time.Sleep(300 * time.Millisecond)
+	s.agent.Stop()
+
+	_, stale, _ := net.ParseCIDR("8.8.0.0/16")
+	s.ipMasqMap.cidrs[stale.String()] = *stale
+
+	source := NewCRDConfigSource(s.client, map[string]string{"node-role": "worker"})
+	agent, err := newIPMasqAgentWithSources([]ConfigSource{source}, s.ipMasqMap, s.ipMasqMapV6)
+	c.Assert(err, check.IsNil)
+	c.Assert(agent.Start(), check.IsNil)
+	s.agent = agent
+
+	ipnets := s.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 1)
+	_, ok := ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+}
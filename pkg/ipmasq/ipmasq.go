@@ -0,0 +1,231 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipmasq implements an agent which reconciles the set of
+// destination CIDRs that must not be masqueraded when traffic leaves the
+// node into the ip-masq-agent BPF maps. Configuration is pulled from one or
+// more pluggable ConfigSources, such as a local file or a Kubernetes CRD.
+package ipmasq
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipmasqmap "github.com/cilium/cilium/pkg/maps/ipmasq"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "ipmasq")
+
+// ipMasqMap is implemented by the BPF map backing one address family of the
+// ip-masq-agent (see pkg/maps/ipmasq.Map) and by the in-memory mocks used by
+// the test suite.
+type ipMasqMap interface {
+	Update(cidr net.IPNet) error
+	Delete(cidr net.IPNet) error
+	Dump() ([]net.IPNet, error)
+}
+
+// IPMasqAgent reconciles the CIDRs read from its ConfigSources into the v4
+// and v6 ip-masq-agent BPF maps. Sources are listed in priority order:
+// the first source that has loaded a given config field wins that field.
+type IPMasqAgent struct {
+	sources []ConfigSource
+
+	mu      lock.Mutex
+	configs map[string]*config
+
+	ipMasqMap   ipMasqMap
+	ipMasqMapV6 ipMasqMap
+
+	observers []Observer
+}
+
+// NewIPMasqAgent returns an agent which watches configFile and, if crdSource
+// is non-nil, the cluster's CiliumIPMasqConfig CRDs, reconciling the result
+// into the real v4 and v6 ip-masq-agent maps. The CRD source takes priority
+// over the file so that cluster policy can override a node's local file.
+func NewIPMasqAgent(configFile string, crdSource *CRDConfigSource) (*IPMasqAgent, error) {
+	sources := []ConfigSource{}
+	if crdSource != nil {
+		sources = append(sources, crdSource)
+	}
+	sources = append(sources, NewFileConfigSource(configFile))
+
+	return newIPMasqAgentWithSources(sources, ipmasqmap.IPv4Map, ipmasqmap.IPv6Map)
+}
+
+// newIPMasqAgent is the single-source (file-only) constructor used by tests
+// against the in-memory ipMasqMap mocks.
+func newIPMasqAgent(configFile string, ipMasqMap, ipMasqMapV6 ipMasqMap) (*IPMasqAgent, error) {
+	return newIPMasqAgentWithSources([]ConfigSource{NewFileConfigSource(configFile)}, ipMasqMap, ipMasqMapV6)
+}
+
+func newIPMasqAgentWithSources(sources []ConfigSource, ipMasqMap, ipMasqMapV6 ipMasqMap) (*IPMasqAgent, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("at least one ConfigSource is required")
+	}
+
+	return &IPMasqAgent{
+		sources:     sources,
+		configs:     make(map[string]*config, len(sources)),
+		ipMasqMap:   ipMasqMap,
+		ipMasqMapV6: ipMasqMapV6,
+	}, nil
+}
+
+// Start starts every configured ConfigSource. Each source loads its initial
+// config synchronously, so the maps are up-to-date by the time Start
+// returns, then watches for changes in the background. If a source fails to
+// start, every source already started is stopped again before returning the
+// error, so a partial failure doesn't leak their background goroutines.
+func (a *IPMasqAgent) Start() error {
+	for i, source := range a.sources {
+		source := source
+		onChange := func(cfg *config, err error) { a.onSourceChange(source.Name(), cfg, err) }
+		if err := source.Start(onChange); err != nil {
+			for _, started := range a.sources[:i] {
+				started.Stop()
+			}
+			return fmt.Errorf("unable to start config source %s: %w", source.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Stop stops every configured ConfigSource.
+func (a *IPMasqAgent) Stop() {
+	for _, source := range a.sources {
+		source.Stop()
+	}
+}
+
+// onSourceChange records the latest config reported by the named source,
+// re-merges all sources in priority order, reconciles the result into the
+// maps, and notifies every registered Observer with the outcome. If loadErr
+// is non-nil, the source's config could not be loaded at all: the previous
+// config (if any) is left in place, the maps are not touched, and observers
+// are notified with ConfigLoadFailed set so that a stuck/broken reload is
+// still visible.
+//
+// NewIPMasqAgent's sources each watch for changes on their own goroutine, so
+// onSourceChange can run concurrently for different sources. The merge and
+// the subsequent dump/diff/update/delete cycle against the maps are held
+// under a.mu for the entire cycle: letting two calls interleave there would
+// let the call that merged an older a.configs snapshot finish reconciling
+// after one that merged a newer snapshot, silently reverting it back
+// (dump-diff-apply TOCTOU). The per-map lock only protects a single
+// Update/Delete/Dump call, not that whole sequence.
+func (a *IPMasqAgent) onSourceChange(name string, cfg *config, loadErr error) {
+	start := time.Now()
+
+	if loadErr != nil {
+		a.mu.Lock()
+		observers := append([]Observer{}, a.observers...)
+		a.mu.Unlock()
+
+		result := ReconcileResult{
+			Source:           name,
+			ConfigLoadFailed: true,
+			Latency:          time.Since(start),
+		}
+		for _, o := range observers {
+			o.OnReconcile(result)
+		}
+		return
+	}
+
+	a.mu.Lock()
+	a.configs[name] = cfg
+	configs := make([]*config, 0, len(a.sources))
+	for _, source := range a.sources {
+		configs = append(configs, a.configs[source.Name()])
+	}
+	merged := mergeConfigs(configs...)
+	// Copy before removing, so the sources' own lists in a.configs are left
+	// as loaded.
+	if merged.MasqLinkLocal {
+		merged.NonMasqueradeCIDRs = applyLinkLocal(append([]string{}, merged.NonMasqueradeCIDRs...), linkLocalCIDRV4, true)
+	}
+	if merged.MasqLinkLocalV6 {
+		merged.NonMasqueradeCIDRsV6 = applyLinkLocal(append([]string{}, merged.NonMasqueradeCIDRsV6...), linkLocalCIDRV6, true)
+	}
+
+	v4CIDRs, v4Errs := parseCIDRs(merged.NonMasqueradeCIDRs)
+	v6CIDRs, v6Errs := parseCIDRs(merged.NonMasqueradeCIDRsV6)
+
+	addedV4, removedV4 := a.reconcile(a.ipMasqMap, v4CIDRs)
+	addedV6, removedV6 := a.reconcile(a.ipMasqMapV6, v6CIDRs)
+	observers := append([]Observer{}, a.observers...)
+	a.mu.Unlock()
+
+	result := ReconcileResult{
+		Source:      name,
+		Added:       addedV4 + addedV6,
+		Removed:     removedV4 + removedV6,
+		ParseErrors: v4Errs + v6Errs,
+		CIDRCount:   len(v4CIDRs) + len(v6CIDRs),
+		Latency:     time.Since(start),
+	}
+	for _, o := range observers {
+		o.OnReconcile(result)
+	}
+}
+
+// reconcile diffs desired against the current contents of m and issues the
+// minimal set of Update/Delete calls to converge, returning how many CIDRs
+// were added and removed. A nil m (address family disabled) is a no-op.
+func (a *IPMasqAgent) reconcile(m ipMasqMap, desired map[string]net.IPNet) (added, removed int) {
+	if m == nil {
+		return 0, 0
+	}
+
+	current, err := m.Dump()
+	if err != nil {
+		log.WithError(err).Warning("unable to dump ip-masq-agent map")
+		return 0, 0
+	}
+
+	for _, cidr := range current {
+		if _, ok := desired[cidr.String()]; ok {
+			continue
+		}
+		if err := m.Delete(cidr); err != nil {
+			log.WithError(err).WithField("cidr", cidr.String()).Warning("unable to remove stale ip-masq-agent entry")
+			continue
+		}
+		removed++
+	}
+
+	currentSet := make(map[string]struct{}, len(current))
+	for _, cidr := range current {
+		currentSet[cidr.String()] = struct{}{}
+	}
+
+	for s, cidr := range desired {
+		if _, ok := currentSet[s]; ok {
+			continue
+		}
+		if err := m.Update(cidr); err != nil {
+			log.WithError(err).WithField("cidr", s).Warning("unable to add ip-masq-agent entry")
+			continue
+		}
+		added++
+	}
+
+	return added, removed
+}
@@ -21,10 +21,12 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"gopkg.in/check.v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/cilium/cilium/pkg/lock"
 )
@@ -88,24 +90,46 @@ func (m *ipMasqMapMock) dumpToSet() map[string]struct{} {
 	return cidrs
 }
 
+type observerMock struct {
+	lock.Mutex
+	calls []ReconcileResult
+}
+
+func (o *observerMock) OnReconcile(result ReconcileResult) {
+	o.Lock()
+	defer o.Unlock()
+	o.calls = append(o.calls, result)
+}
+
+func (o *observerMock) len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.calls)
+}
+
 type IPMasqTestSuite struct {
 	ipMasqMap   *ipMasqMapMock
+	ipMasqMapV6 *ipMasqMapMock
 	ipMasqAgent *IPMasqAgent
 	configFile  *os.File
+	observer    *observerMock
 }
 
 var _ = check.Suite(&IPMasqTestSuite{})
 
 func (i *IPMasqTestSuite) SetUpTest(c *check.C) {
 	i.ipMasqMap = &ipMasqMapMock{cidrs: map[string]net.IPNet{}}
+	i.ipMasqMapV6 = &ipMasqMapMock{cidrs: map[string]net.IPNet{}}
+	i.observer = &observerMock{}
 
 	configFile, err := ioutil.TempFile("", "ipmasq-test")
 	c.Assert(err, check.IsNil)
 	i.configFile = configFile
 
-	agent, err := newIPMasqAgent(configFile.Name(), i.ipMasqMap)
+	agent, err := newIPMasqAgent(configFile.Name(), i.ipMasqMap, i.ipMasqMapV6)
 	c.Assert(err, check.IsNil)
 	i.ipMasqAgent = agent
+	i.ipMasqAgent.AddObserver(i.observer)
 	i.ipMasqAgent.Start()
 }
 
@@ -125,6 +149,8 @@ func (i *IPMasqTestSuite) TestUpdate(c *check.C) {
 	c.Assert(ok, check.Equals, true)
 	_, ok = ipnets["2.2.0.0/16"]
 	c.Assert(ok, check.Equals, true)
+	// The initial load at Start() fires one callback, the write above a second.
+	c.Assert(i.observer.len(), check.Equals, 2)
 
 	// Write new config
 	_, err = i.configFile.Seek(0, 0)
@@ -139,6 +165,7 @@ func (i *IPMasqTestSuite) TestUpdate(c *check.C) {
 	c.Assert(ok, check.Equals, true)
 	_, ok = ipnets["2.2.0.0/16"]
 	c.Assert(ok, check.Equals, true)
+	c.Assert(i.observer.len(), check.Equals, 3)
 
 	// Write new config in JSON
 	_, err = i.configFile.Seek(0, 0)
@@ -153,6 +180,7 @@ func (i *IPMasqTestSuite) TestUpdate(c *check.C) {
 	c.Assert(ok, check.Equals, true)
 	_, ok = ipnets["1.1.0.0/16"]
 	c.Assert(ok, check.Equals, true)
+	c.Assert(i.observer.len(), check.Equals, 4)
 
 	// Delete file, should remove the CIDRs
 	err = os.Remove(i.configFile.Name())
@@ -162,6 +190,116 @@ func (i *IPMasqTestSuite) TestUpdate(c *check.C) {
 	time.Sleep(300 * time.Millisecond)
 	ipnets = i.ipMasqMap.dumpToSet()
 	c.Assert(len(ipnets), check.Equals, 0)
+	c.Assert(i.observer.len(), check.Equals, 5)
+}
+
+func (i *IPMasqTestSuite) TestDefaultsAndLinkLocalToggle(c *check.C) {
+	// With no nonMasqueradeCIDRs set, the defaults apply, including the
+	// link-local range since masqLinkLocal defaults to false.
+	_, err := i.configFile.WriteString("masqLinkLocal: false")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets := i.ipMasqMap.dumpToSet()
+	_, ok := ipnets["169.254.0.0/16"]
+	c.Assert(ok, check.Equals, true)
+	_, ok = ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+
+	// masqLinkLocal: true drops the link-local range from the defaults,
+	// letting it be masqueraded like any other destination.
+	_, err = i.configFile.Seek(0, 0)
+	c.Assert(err, check.IsNil)
+	err = i.configFile.Truncate(0)
+	c.Assert(err, check.IsNil)
+	_, err = i.configFile.WriteString("masqLinkLocal: true")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets = i.ipMasqMap.dumpToSet()
+	_, ok = ipnets["169.254.0.0/16"]
+	c.Assert(ok, check.Equals, false)
+	_, ok = ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+}
+
+func (i *IPMasqTestSuite) TestLinkLocalToggleWithCustomCIDRs(c *check.C) {
+	// The toggle must still take effect once the operator sets an explicit
+	// nonMasqueradeCIDRs list: masqLinkLocal defaults to false, so
+	// link-local is added to a custom list too, not just the default one.
+	_, err := i.configFile.WriteString("nonMasqueradeCIDRs:\n- 10.0.0.0/8")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets := i.ipMasqMap.dumpToSet()
+	_, ok := ipnets["169.254.0.0/16"]
+	c.Assert(ok, check.Equals, true)
+	_, ok = ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+
+	// masqLinkLocal: true must drop link-local from a custom list as well.
+	_, err = i.configFile.Seek(0, 0)
+	c.Assert(err, check.IsNil)
+	err = i.configFile.Truncate(0)
+	c.Assert(err, check.IsNil)
+	_, err = i.configFile.WriteString("nonMasqueradeCIDRs:\n- 10.0.0.0/8\nmasqLinkLocal: true")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets = i.ipMasqMap.dumpToSet()
+	_, ok = ipnets["169.254.0.0/16"]
+	c.Assert(ok, check.Equals, false)
+	_, ok = ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+
+	// Explicitly listing the link-local range with masqLinkLocal: true must
+	// not leave it in the set either.
+	_, err = i.configFile.Seek(0, 0)
+	c.Assert(err, check.IsNil)
+	err = i.configFile.Truncate(0)
+	c.Assert(err, check.IsNil)
+	_, err = i.configFile.WriteString("nonMasqueradeCIDRs:\n- 10.0.0.0/8\n- 169.254.0.0/16\nmasqLinkLocal: true")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	ipnets = i.ipMasqMap.dumpToSet()
+	_, ok = ipnets["169.254.0.0/16"]
+	c.Assert(ok, check.Equals, false)
+	_, ok = ipnets["10.0.0.0/8"]
+	c.Assert(ok, check.Equals, true)
+}
+
+func (i *IPMasqTestSuite) TestWholeFileParseFailureIsObserved(c *check.C) {
+	_, err := i.configFile.WriteString("nonMasqueradeCIDRs:\n- 1.1.1.1/32")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(i.observer.len(), check.Equals, 2)
+
+	// 1.1.1.1/32 plus 169.254.0.0/16, since masqLinkLocal defaults to false.
+	ipnets := i.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 2)
+
+	// A file that fails to parse as a whole (not just a bad entry) must
+	// still fire an observer callback, so that a stuck reload is visible,
+	// and must leave the previously loaded config and maps untouched.
+	_, err = i.configFile.Seek(0, 0)
+	c.Assert(err, check.IsNil)
+	err = i.configFile.Truncate(0)
+	c.Assert(err, check.IsNil)
+	_, err = i.configFile.WriteString("nonMasqueradeCIDRs:\n\t- 2.2.2.2/32")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	c.Assert(i.observer.len(), check.Equals, 3)
+	result := i.observer.calls[2]
+	c.Assert(result.ConfigLoadFailed, check.Equals, true)
+	c.Assert(result.Added, check.Equals, 0)
+	c.Assert(result.Removed, check.Equals, 0)
+
+	ipnets = i.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 2)
+	_, ok := ipnets["1.1.1.1/32"]
+	c.Assert(ok, check.Equals, true)
 }
 
 func (i *IPMasqTestSuite) TestRestore(c *check.C) {
@@ -176,7 +314,7 @@ func (i *IPMasqTestSuite) TestRestore(c *check.C) {
 	_, err := i.configFile.WriteString("nonMasqueradeCIDRs:\n- 4.4.0.0/16")
 	c.Assert(err, check.IsNil)
 
-	i.ipMasqAgent, err = newIPMasqAgent(i.configFile.Name(), i.ipMasqMap)
+	i.ipMasqAgent, err = newIPMasqAgent(i.configFile.Name(), i.ipMasqMap, i.ipMasqMapV6)
 	c.Assert(err, check.IsNil)
 	i.ipMasqAgent.Start()
 	time.Sleep(300 * time.Millisecond)
@@ -195,7 +333,7 @@ func (i *IPMasqTestSuite) TestRestore(c *check.C) {
 	c.Assert(err, check.IsNil)
 	_, err = i.configFile.WriteString("nonMasqueradeCIDRs:\n- 3.3.0.0/16")
 	c.Assert(err, check.IsNil)
-	i.ipMasqAgent, err = newIPMasqAgent(i.configFile.Name(), i.ipMasqMap)
+	i.ipMasqAgent, err = newIPMasqAgent(i.configFile.Name(), i.ipMasqMap, i.ipMasqMapV6)
 	c.Assert(err, check.IsNil)
 	i.ipMasqAgent.Start()
 
@@ -203,4 +341,204 @@ func (i *IPMasqTestSuite) TestRestore(c *check.C) {
 	c.Assert(len(ipnets), check.Equals, 1)
 	_, ok = ipnets["3.3.0.0/16"]
 	c.Assert(ok, check.Equals, true)
-}
\ No newline at end of file
+}
+
+func (i *IPMasqTestSuite) TestUpdateDualStack(c *check.C) {
+	// YAML config with both families. Each family's list also gets its
+	// link-local range, since masqLinkLocal(V6) defaults to false.
+	_, err := i.configFile.WriteString("nonMasqueradeCIDRs:\n- 1.1.1.1/32\nnonMasqueradeCIDRsV6:\n- 2001:db8::/32\n- fd00::/8")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	v4 := i.ipMasqMap.dumpToSet()
+	c.Assert(len(v4), check.Equals, 2)
+	_, ok := v4["1.1.1.1/32"]
+	c.Assert(ok, check.Equals, true)
+
+	v6 := i.ipMasqMapV6.dumpToSet()
+	c.Assert(len(v6), check.Equals, 3)
+	_, ok = v6["2001:db8::/32"]
+	c.Assert(ok, check.Equals, true)
+	_, ok = v6["fd00::/8"]
+	c.Assert(ok, check.Equals, true)
+
+	// Same config in JSON.
+	_, err = i.configFile.Seek(0, 0)
+	c.Assert(err, check.IsNil)
+	err = i.configFile.Truncate(0)
+	c.Assert(err, check.IsNil)
+	_, err = i.configFile.WriteString(`{"nonMasqueradeCIDRs": ["1.1.1.1/32"], "nonMasqueradeCIDRsV6": ["2001:db8::/32"]}`)
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	v6 = i.ipMasqMapV6.dumpToSet()
+	c.Assert(len(v6), check.Equals, 2)
+	_, ok = v6["2001:db8::/32"]
+	c.Assert(ok, check.Equals, true)
+
+	// Delete file: both families should be torn down.
+	err = os.Remove(i.configFile.Name())
+	c.Assert(err, check.IsNil)
+	err = i.configFile.Close()
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	c.Assert(len(i.ipMasqMap.dumpToSet()), check.Equals, 0)
+	c.Assert(len(i.ipMasqMapV6.dumpToSet()), check.Equals, 0)
+}
+
+func (i *IPMasqTestSuite) TestRestoreStaleV6(c *check.C) {
+	i.ipMasqAgent.Stop()
+
+	_, cidr, _ := net.ParseCIDR("2001:db8::/32")
+	i.ipMasqMapV6.cidrs[cidr.String()] = *cidr
+	_, cidr, _ = net.ParseCIDR("fd00::/8")
+	i.ipMasqMapV6.cidrs[cidr.String()] = *cidr
+
+	_, err := i.configFile.WriteString("nonMasqueradeCIDRsV6:\n- fd00::/8")
+	c.Assert(err, check.IsNil)
+
+	i.ipMasqAgent, err = newIPMasqAgent(i.configFile.Name(), i.ipMasqMap, i.ipMasqMapV6)
+	c.Assert(err, check.IsNil)
+	i.ipMasqAgent.Start()
+
+	// fd00::/8 plus fe80::/10, since masqLinkLocalV6 defaults to false.
+	v6 := i.ipMasqMapV6.dumpToSet()
+	c.Assert(len(v6), check.Equals, 2)
+	_, ok := v6["fd00::/8"]
+	c.Assert(ok, check.Equals, true)
+}
+
+// MultiSourceTestSuite drives a FileConfigSource and a CRDConfigSource
+// together, each firing onSourceChange from its own goroutine (the file
+// watcher vs. the CRD informer), to guard against the two reconcile cycles
+// interleaving and one reverting the other's result.
+type MultiSourceTestSuite struct {
+	client      *fakeCRDClient
+	ipMasqMap   *ipMasqMapMock
+	ipMasqMapV6 *ipMasqMapMock
+	ipMasqAgent *IPMasqAgent
+	configFile  *os.File
+}
+
+var _ = check.Suite(&MultiSourceTestSuite{})
+
+func (i *MultiSourceTestSuite) SetUpTest(c *check.C) {
+	i.client = newFakeCRDClient()
+	i.ipMasqMap = &ipMasqMapMock{cidrs: map[string]net.IPNet{}}
+	i.ipMasqMapV6 = &ipMasqMapMock{cidrs: map[string]net.IPNet{}}
+
+	configFile, err := ioutil.TempFile("", "ipmasq-test")
+	c.Assert(err, check.IsNil)
+	i.configFile = configFile
+
+	crdSource := NewCRDConfigSource(i.client, map[string]string{"node-role": "worker"})
+	sources := []ConfigSource{crdSource, NewFileConfigSource(configFile.Name())}
+	agent, err := newIPMasqAgentWithSources(sources, i.ipMasqMap, i.ipMasqMapV6)
+	c.Assert(err, check.IsNil)
+	i.ipMasqAgent = agent
+	c.Assert(i.ipMasqAgent.Start(), check.IsNil)
+}
+
+func (i *MultiSourceTestSuite) TearDownTest(c *check.C) {
+	i.ipMasqAgent.Stop()
+	os.Remove(i.configFile.Name())
+}
+
+func (i *MultiSourceTestSuite) TestConcurrentFileAndCRDReconcileConverge(c *check.C) {
+	// The CRD source owns nonMasqueradeCIDRs (it has priority over the
+	// file), the file owns nonMasqueradeCIDRsV6, so each round's last write
+	// to each family has an unambiguous expected outcome: if the two
+	// sources' reconcile cycles aren't serialized end-to-end, a
+	// late-finishing cycle built from a stale snapshot can silently
+	// overwrite the other family's already-converged result too, since
+	// both families are reconciled together in the same cycle.
+	const rounds = 20
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for n := 0; n < rounds; n++ {
+			i.client.add(&CiliumIPMasqConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"},
+				Spec:       CiliumIPMasqConfigSpec{NonMasqueradeCIDRs: []string{fmt.Sprintf("10.%d.0.0/16", n)}},
+			})
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for n := 0; n < rounds; n++ {
+			c.Assert(i.configFile.Truncate(0), check.IsNil)
+			_, err := i.configFile.WriteAt([]byte(fmt.Sprintf("nonMasqueradeCIDRsV6:\n- fd00:%d::/32", n)), 0)
+			c.Assert(err, check.IsNil)
+		}
+	}()
+
+	wg.Wait()
+	time.Sleep(500 * time.Millisecond)
+
+	v4 := i.ipMasqMap.dumpToSet()
+	c.Assert(len(v4), check.Equals, 1)
+	_, ok := v4[fmt.Sprintf("10.%d.0.0/16", rounds-1)]
+	c.Assert(ok, check.Equals, true)
+
+	// The file's last CIDR plus fe80::/10, since masqLinkLocalV6 defaults
+	// to false.
+	v6 := i.ipMasqMapV6.dumpToSet()
+	c.Assert(len(v6), check.Equals, 2)
+	_, ok = v6[fmt.Sprintf("fd00:%d::/32", rounds-1)]
+	c.Assert(ok, check.Equals, true)
+}
+
+// fakeConfigSource is a bare-bones ConfigSource used to drive
+// IPMasqAgent.Start's rollback behavior without the overhead of a real file
+// or CRD source.
+type fakeConfigSource struct {
+	name     string
+	startErr error
+	started  bool
+	stopped  bool
+}
+
+func (f *fakeConfigSource) Name() string { return f.name }
+
+func (f *fakeConfigSource) Start(onChange func(cfg *config, err error)) error {
+	if f.startErr != nil {
+		return f.startErr
+	}
+	f.started = true
+	onChange(&config{}, nil)
+	return nil
+}
+
+func (f *fakeConfigSource) Stop() { f.stopped = true }
+
+type AgentStartRollbackTestSuite struct{}
+
+var _ = check.Suite(&AgentStartRollbackTestSuite{})
+
+func (s *AgentStartRollbackTestSuite) TestStartStopsAlreadyStartedSourcesOnFailure(c *check.C) {
+	ok1 := &fakeConfigSource{name: "ok1"}
+	ok2 := &fakeConfigSource{name: "ok2"}
+	failing := &fakeConfigSource{name: "failing", startErr: fmt.Errorf("boom")}
+
+	agent, err := newIPMasqAgentWithSources(
+		[]ConfigSource{ok1, ok2, failing},
+		&ipMasqMapMock{cidrs: map[string]net.IPNet{}},
+		&ipMasqMapMock{cidrs: map[string]net.IPNet{}},
+	)
+	c.Assert(err, check.IsNil)
+
+	err = agent.Start()
+	c.Assert(err, check.ErrorMatches, ".*boom.*")
+
+	// Both sources that started successfully before "failing" errored out
+	// must be stopped again, so a partial Start doesn't leak their
+	// background goroutines.
+	c.Assert(ok1.started, check.Equals, true)
+	c.Assert(ok1.stopped, check.Equals, true)
+	c.Assert(ok2.started, check.Equals, true)
+	c.Assert(ok2.stopped, check.Equals, true)
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmasq
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricCIDRs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cilium",
+		Subsystem: "ipmasq",
+		Name:      "cidrs",
+		Help:      "Number of non-masquerade CIDRs currently programmed, by config source",
+	}, []string{"source"})
+
+	metricConfigReloadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cilium",
+		Subsystem: "ipmasq",
+		Name:      "config_reload_errors_total",
+		Help:      "Number of configs that failed to load plus non-masquerade CIDR/range entries that failed to parse, by config source",
+	}, []string{"source"})
+
+	metricLastReloadTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cilium",
+		Subsystem: "ipmasq",
+		Name:      "last_reload_timestamp_seconds",
+		Help:      "Unix timestamp of the last reconcile cycle, by config source",
+	}, []string{"source"})
+
+	metricReconcileDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cilium",
+		Subsystem: "ipmasq",
+		Name:      "reconcile_duration_seconds",
+		Help:      "Time taken to merge the config and reconcile both maps on the last reconcile cycle, by config source",
+	}, []string{"source"})
+)
+
+// PrometheusObserver is the default Observer. It keeps cilium_ipmasq_cidrs,
+// cilium_ipmasq_config_reload_errors_total,
+// cilium_ipmasq_last_reload_timestamp_seconds and
+// cilium_ipmasq_reconcile_duration_seconds up to date on every reconcile
+// cycle.
+type PrometheusObserver struct{}
+
+// NewPrometheusObserver registers the ip-masq-agent metrics with registry
+// and returns an Observer that keeps them up to date. Registering the same
+// metrics with the same registry more than once (e.g. a restarted agent)
+// is not an error.
+func NewPrometheusObserver(registry prometheus.Registerer) *PrometheusObserver {
+	collectors := []prometheus.Collector{
+		metricCIDRs, metricConfigReloadErrors, metricLastReloadTimestamp, metricReconcileDuration,
+	}
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				log.WithError(err).Warning("unable to register ip-masq-agent metric")
+			}
+		}
+	}
+	return &PrometheusObserver{}
+}
+
+// OnReconcile implements Observer.
+func (p *PrometheusObserver) OnReconcile(result ReconcileResult) {
+	if result.ConfigLoadFailed {
+		metricConfigReloadErrors.WithLabelValues(result.Source).Inc()
+		return
+	}
+
+	metricCIDRs.WithLabelValues(result.Source).Set(float64(result.CIDRCount))
+	if result.ParseErrors > 0 {
+		metricConfigReloadErrors.WithLabelValues(result.Source).Add(float64(result.ParseErrors))
+	}
+	metricLastReloadTimestamp.WithLabelValues(result.Source).SetToCurrentTime()
+	metricReconcileDuration.WithLabelValues(result.Source).Set(result.Latency.Seconds())
+}
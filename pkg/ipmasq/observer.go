@@ -0,0 +1,57 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmasq
+
+import "time"
+
+// Observer is notified after every reconcile cycle, so that operators can
+// alert on stuck reloads or drift between the config and the maps.
+type Observer interface {
+	// OnReconcile is called once per ConfigSource change, after the v4 and
+	// v6 maps have converged (or failed to).
+	OnReconcile(result ReconcileResult)
+}
+
+// ReconcileResult summarizes the outcome of a single reconcile cycle
+// triggered by a ConfigSource change.
+type ReconcileResult struct {
+	// Source is the name of the ConfigSource that triggered this cycle.
+	Source string
+	// Added and Removed count the CIDRs added to and removed from the v4
+	// and v6 maps combined.
+	Added, Removed int
+	// ParseErrors counts config entries that could not be parsed as a CIDR
+	// or range, across both address families.
+	ParseErrors int
+	// ConfigLoadFailed is set when the source's config could not be loaded
+	// at all (e.g. the file failed to parse as YAML/JSON). The previous
+	// config, if any, is left in effect and the maps are not touched; Added,
+	// Removed and CIDRCount are always zero in this case.
+	ConfigLoadFailed bool
+	// CIDRCount is the total number of CIDRs desired across both address
+	// families after this cycle.
+	CIDRCount int
+	// Latency is the time taken to merge the config and reconcile both
+	// maps.
+	Latency time.Duration
+}
+
+// AddObserver registers o to be notified after every future reconcile
+// cycle.
+func (a *IPMasqAgent) AddObserver(o Observer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.observers = append(a.observers, o)
+}
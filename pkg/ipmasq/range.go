@@ -0,0 +1,126 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmasq
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// expandCIDROrRange parses entry, which is either CIDR notation
+// ("10.0.0.0/8") or an inclusive IP range ("10.0.0.5-10.0.0.37"), and
+// returns the minimal set of CIDR blocks that together cover it.
+func expandCIDROrRange(entry string) ([]net.IPNet, error) {
+	start, end, ok := splitRange(entry)
+	if !ok {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		return []net.IPNet{*ipnet}, nil
+	}
+
+	return rangeToCIDRs(start, end)
+}
+
+// splitRange splits entry on its first "-" into a start and end address. It
+// reports ok=false if entry contains no "-", i.e. it isn't a range.
+func splitRange(entry string) (start, end string, ok bool) {
+	idx := strings.IndexByte(entry, '-')
+	if idx < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(entry[:idx]), strings.TrimSpace(entry[idx+1:]), true
+}
+
+// rangeToCIDRs decomposes the inclusive address range [startStr, endStr]
+// into the minimal set of CIDR blocks that exactly cover it: walking from
+// start, at each step it emits the largest prefix aligned on start that
+// does not extend past end, then advances start past that block.
+func rangeToCIDRs(startStr, endStr string) ([]net.IPNet, error) {
+	startIP := net.ParseIP(startStr)
+	if startIP == nil {
+		return nil, fmt.Errorf("invalid range start %q", startStr)
+	}
+	endIP := net.ParseIP(endStr)
+	if endIP == nil {
+		return nil, fmt.Errorf("invalid range end %q", endStr)
+	}
+
+	startV4, endV4 := startIP.To4(), endIP.To4()
+	var bits int
+	var start, end *big.Int
+	switch {
+	case startV4 != nil && endV4 != nil:
+		bits = net.IPv4len * 8
+		start, end = new(big.Int).SetBytes(startV4), new(big.Int).SetBytes(endV4)
+	case startV4 == nil && endV4 == nil:
+		bits = net.IPv6len * 8
+		start, end = new(big.Int).SetBytes(startIP.To16()), new(big.Int).SetBytes(endIP.To16())
+	default:
+		return nil, fmt.Errorf("range %s-%s mixes IPv4 and IPv6 addresses", startStr, endStr)
+	}
+
+	if start.Cmp(end) > 0 {
+		return nil, fmt.Errorf("inverted range %s-%s: start is after end", startStr, endStr)
+	}
+
+	one := big.NewInt(1)
+	var cidrs []net.IPNet
+	for start.Cmp(end) <= 0 {
+		// The block can be at most as large as start's alignment allows...
+		hostBits := trailingZeroBits(start, bits)
+
+		// ... and at most as large as what's left to cover.
+		remaining := new(big.Int).Sub(end, start)
+		remaining.Add(remaining, one)
+		if maxByRemaining := remaining.BitLen() - 1; maxByRemaining < hostBits {
+			hostBits = maxByRemaining
+		}
+
+		cidrs = append(cidrs, net.IPNet{
+			IP:   net.IP(bigToBytes(start, bits/8)),
+			Mask: net.CIDRMask(bits-hostBits, bits),
+		})
+
+		start.Add(start, new(big.Int).Lsh(one, uint(hostBits)))
+	}
+
+	return cidrs, nil
+}
+
+// trailingZeroBits returns the number of trailing zero bits in x, capped at
+// bits (the address width), since a value of 0 can start a block as large
+// as the entire address space.
+func trailingZeroBits(x *big.Int, bits int) int {
+	if x.Sign() == 0 {
+		return bits
+	}
+	n := 0
+	for x.Bit(n) == 0 {
+		n++
+	}
+	return n
+}
+
+// bigToBytes renders n as a big-endian byte slice of exactly byteLen bytes.
+func bigToBytes(n *big.Int, byteLen int) []byte {
+	raw := n.Bytes()
+	out := make([]byte, byteLen)
+	copy(out[byteLen-len(raw):], raw)
+	return out
+}
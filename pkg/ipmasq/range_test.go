@@ -0,0 +1,119 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !privileged_tests
+
+package ipmasq
+
+import (
+	"net"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type RangeTestSuite struct{}
+
+var _ = check.Suite(&RangeTestSuite{})
+
+func cidrStrs(cidrs []net.IPNet) []string {
+	strs := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		strs = append(strs, cidr.String())
+	}
+	return strs
+}
+
+func (s *RangeTestSuite) TestSinglePrefix(c *check.C) {
+	cidrs, err := rangeToCIDRs("10.0.0.0", "10.0.0.255")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"10.0.0.0/24"})
+}
+
+func (s *RangeTestSuite) TestTwoPrefixes(c *check.C) {
+	cidrs, err := rangeToCIDRs("10.0.0.0", "10.0.0.191")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"10.0.0.0/25", "10.0.0.128/26"})
+}
+
+func (s *RangeTestSuite) TestManyPrefixes(c *check.C) {
+	cidrs, err := rangeToCIDRs("10.0.0.5", "10.0.0.37")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{
+		"10.0.0.5/32",
+		"10.0.0.6/31",
+		"10.0.0.8/29",
+		"10.0.0.16/28",
+		"10.0.0.32/30",
+		"10.0.0.36/31",
+	})
+}
+
+func (s *RangeTestSuite) TestSingleAddress(c *check.C) {
+	cidrs, err := rangeToCIDRs("10.0.0.5", "10.0.0.5")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"10.0.0.5/32"})
+}
+
+func (s *RangeTestSuite) TestLowEdge(c *check.C) {
+	cidrs, err := rangeToCIDRs("0.0.0.0", "0.0.0.3")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"0.0.0.0/30"})
+}
+
+func (s *RangeTestSuite) TestHighEdge(c *check.C) {
+	cidrs, err := rangeToCIDRs("255.255.255.252", "255.255.255.255")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"255.255.255.252/30"})
+}
+
+func (s *RangeTestSuite) TestFullRange(c *check.C) {
+	cidrs, err := rangeToCIDRs("0.0.0.0", "255.255.255.255")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"0.0.0.0/0"})
+}
+
+func (s *RangeTestSuite) TestIPv6Range(c *check.C) {
+	cidrs, err := rangeToCIDRs("2001:db8::", "2001:db8::3")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"2001:db8::/126"})
+}
+
+func (s *RangeTestSuite) TestInvertedRange(c *check.C) {
+	_, err := rangeToCIDRs("10.0.0.37", "10.0.0.5")
+	c.Assert(err, check.ErrorMatches, ".*inverted range.*")
+}
+
+func (s *RangeTestSuite) TestCrossFamilyRange(c *check.C) {
+	_, err := rangeToCIDRs("10.0.0.0", "::1")
+	c.Assert(err, check.ErrorMatches, ".*mixes IPv4 and IPv6.*")
+}
+
+func (s *RangeTestSuite) TestExpandCIDROrRangePassesThroughPlainCIDR(c *check.C) {
+	cidrs, err := expandCIDROrRange("10.0.0.0/24")
+	c.Assert(err, check.IsNil)
+	c.Assert(cidrStrs(cidrs), check.DeepEquals, []string{"10.0.0.0/24"})
+}
+
+func (i *IPMasqTestSuite) TestUpdateWithRange(c *check.C) {
+	_, err := i.configFile.WriteString("nonMasqueradeCIDRs:\n- 10.0.0.4-10.0.0.5")
+	c.Assert(err, check.IsNil)
+	time.Sleep(300 * time.Millisecond)
+
+	// 10.0.0.4/31 plus 169.254.0.0/16, since masqLinkLocal defaults to false.
+	ipnets := i.ipMasqMap.dumpToSet()
+	c.Assert(len(ipnets), check.Equals, 2)
+	_, ok := ipnets["10.0.0.4/31"]
+	c.Assert(ok, check.Equals, true)
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipmasq contains the BPF LPM trie maps backing the ip-masq-agent:
+// one per address family, holding the destination prefixes that must not be
+// masqueraded when traffic egresses the node.
+package ipmasq
+
+import (
+	"fmt"
+	"net"
+	"unsafe"
+
+	"github.com/cilium/cilium/pkg/bpf"
+)
+
+const (
+	// MapNameV4 is the name of the IPv4 ip-masq-agent map.
+	MapNameV4 = "cilium_ipmasq_v4"
+	// MapNameV6 is the name of the IPv6 ip-masq-agent map.
+	MapNameV6 = "cilium_ipmasq_v6"
+
+	maxEntries = 16384
+)
+
+// Key4 is the LPM trie key of the IPv4 ip-masq-agent map.
+type Key4 struct {
+	PrefixLen uint32
+	Address   uint32
+}
+
+// Key6 is the LPM trie key of the IPv6 ip-masq-agent map.
+type Key6 struct {
+	PrefixLen uint32
+	Address   [16]byte
+}
+
+func newKey4(cidr net.IPNet) (Key4, error) {
+	ones, bits := cidr.Mask.Size()
+	if bits != net.IPv4len*8 {
+		return Key4{}, fmt.Errorf("%s is not an IPv4 CIDR", cidr.String())
+	}
+	v4 := cidr.IP.To4()
+	if v4 == nil {
+		return Key4{}, fmt.Errorf("%s is not an IPv4 CIDR", cidr.String())
+	}
+	var addr uint32
+	for _, b := range v4 {
+		addr = addr<<8 | uint32(b)
+	}
+	return Key4{PrefixLen: uint32(ones), Address: addr}, nil
+}
+
+func newKey6(cidr net.IPNet) (Key6, error) {
+	ones, bits := cidr.Mask.Size()
+	if bits != net.IPv6len*8 {
+		return Key6{}, fmt.Errorf("%s is not an IPv6 CIDR", cidr.String())
+	}
+	var key Key6
+	copy(key.Address[:], cidr.IP.To16())
+	key.PrefixLen = uint32(ones)
+	return key, nil
+}
+
+// Map is a thin wrapper around a BPF LPM trie map that stores one address
+// family of the ip-masq-agent's non-masquerade CIDR set.
+type Map struct {
+	*bpf.Map
+	v6 bool
+}
+
+// IPv4Map is the singleton ip-masq-agent map for IPv4 CIDRs.
+var IPv4Map = newMap(MapNameV4, false)
+
+// IPv6Map is the singleton ip-masq-agent map for IPv6 CIDRs.
+var IPv6Map = newMap(MapNameV6, true)
+
+func newMap(name string, v6 bool) *Map {
+	keySize := int(unsafe.Sizeof(Key4{}))
+	if v6 {
+		keySize = int(unsafe.Sizeof(Key6{}))
+	}
+
+	return &Map{
+		Map: bpf.NewMap(name,
+			bpf.MapTypeLPMTrie,
+			keySize,
+			0, // value is presence-only
+			maxEntries,
+			bpf.BPF_F_NO_PREALLOC,
+			nil,
+		),
+		v6: v6,
+	}
+}
+
+// Update inserts cidr into the map, masquerade-exempting it.
+func (m *Map) Update(cidr net.IPNet) error {
+	key, err := m.key(cidr)
+	if err != nil {
+		return err
+	}
+	return m.Map.Update(key, bpf.NewNoValue())
+}
+
+// Delete removes cidr from the map.
+func (m *Map) Delete(cidr net.IPNet) error {
+	key, err := m.key(cidr)
+	if err != nil {
+		return err
+	}
+	return m.Map.Delete(key)
+}
+
+// Dump returns every CIDR currently stored in the map.
+func (m *Map) Dump() ([]net.IPNet, error) {
+	cidrs := []net.IPNet{}
+	err := m.Map.DumpWithCallback(func(key bpf.MapKey, _ bpf.MapValue) {
+		switch k := key.(type) {
+		case *Key4:
+			cidrs = append(cidrs, net.IPNet{
+				IP:   net.IPv4(byte(k.Address>>24), byte(k.Address>>16), byte(k.Address>>8), byte(k.Address)),
+				Mask: net.CIDRMask(int(k.PrefixLen), net.IPv4len*8),
+			})
+		case *Key6:
+			addr := make(net.IP, net.IPv6len)
+			copy(addr, k.Address[:])
+			cidrs = append(cidrs, net.IPNet{
+				IP:   addr,
+				Mask: net.CIDRMask(int(k.PrefixLen), net.IPv6len*8),
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cidrs, nil
+}
+
+func (m *Map) key(cidr net.IPNet) (bpf.MapKey, error) {
+	if m.v6 {
+		key, err := newKey6(cidr)
+		return &key, err
+	}
+	key, err := newKey4(cidr)
+	return &key, err
+}